@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CredentialProvider supplies the bearer token used to authenticate
+// requests to Secret Server. Token is called whenever the Server's cached
+// access token is missing or within its expiry skew, so a provider should
+// fetch (or otherwise produce) a fresh token on every call rather than
+// caching it itself; Server takes care of caching. A zero expiry means the
+// token does not expire and should be reused until a request fails.
+type CredentialProvider interface {
+	Token(ctx context.Context) (string, time.Time, error)
+}
+
+// StaticTokenProvider is a CredentialProvider for a fixed, pre-obtained
+// access token, such as a personal access token issued out of band. It
+// never expires.
+type StaticTokenProvider struct {
+	AccessToken string
+}
+
+// Token implements CredentialProvider.
+func (p StaticTokenProvider) Token(ctx context.Context) (string, time.Time, error) {
+	return p.AccessToken, time.Time{}, nil
+}
+
+// PasswordProvider authenticates with a Secret Server local username and
+// password, the SDK's original authentication path. It exchanges the
+// password for an access token via grant_type=password, and transparently
+// uses grant_type=refresh_token on subsequent calls for as long as the
+// refresh token Secret Server returns stays valid, falling back to the
+// password grant otherwise.
+type PasswordProvider struct {
+	Username, Password, Domain string
+
+	// server is set by New when this provider is passed as, or derived
+	// for, Configuration.CredentialProvider; it supplies the token
+	// endpoint and request plumbing.
+	server *Server
+}
+
+// Token implements CredentialProvider.
+func (p *PasswordProvider) Token(ctx context.Context) (string, time.Time, error) {
+	// Token is only ever called by getAccessTokenContext, which already
+	// holds p.server.tokens.mu, so reading and writing the cached
+	// RefreshToken here needs no locking of its own.
+	if refreshToken := p.server.tokens.token.RefreshToken; refreshToken != "" {
+		token, err := p.server.refreshToken(ctx, refreshToken)
+		if err == nil {
+			p.server.tokens.token.RefreshToken = token.RefreshToken
+			return token.AccessToken, token.Expiry, nil
+		}
+		log.Warn().Err(err).Msg("refreshing access token failed, falling back to password grant")
+	}
+
+	token, err := p.server.passwordGrant(ctx, p.Username, p.Password, p.Domain)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	p.server.tokens.token.RefreshToken = token.RefreshToken
+
+	return token.AccessToken, token.Expiry, nil
+}
+
+// URLProvider is a CredentialProvider that GETs a URL and extracts a
+// subject token from the response, for environments (CI runners, cloud
+// metadata services) that hand out short-lived tokens over HTTP. Exactly
+// one of JSONPointer or Header should be set; if neither is, the whole
+// response body, trimmed of surrounding whitespace, is used as the token.
+type URLProvider struct {
+	URL string
+
+	// JSONPointer is an RFC 6901 pointer (e.g. "/access_token") into a
+	// JSON response body.
+	JSONPointer string
+
+	// Header, if set, names a response header to read the token from
+	// instead of the body.
+	Header string
+
+	// HTTPClient is used to make the request. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// Token implements CredentialProvider.
+func (p URLProvider) Token(ctx context.Context) (string, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	if p.Header != "" {
+		if _, _, err := handleResponse(resp, nil); err != nil {
+			return "", time.Time{}, err
+		}
+		return resp.Header.Get(p.Header), time.Time{}, nil
+	}
+
+	data, _, err := handleResponse(resp, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if p.JSONPointer == "" {
+		return strings.TrimSpace(string(data)), time.Time{}, nil
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return "", time.Time{}, err
+	}
+
+	token, err := jsonPointer(body, p.JSONPointer)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, time.Time{}, nil
+}
+
+// jsonPointer resolves a small subset of RFC 6901: a "/"-separated path of
+// object keys into a decoded JSON value, returning the leaf as a string.
+func jsonPointer(value interface{}, pointer string) (string, error) {
+	for _, key := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		key = strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")
+
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("json pointer %q: %q is not an object", pointer, key)
+		}
+
+		value, ok = object[key]
+		if !ok {
+			return "", fmt.Errorf("json pointer %q: no such key %q", pointer, key)
+		}
+	}
+
+	token, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("json pointer %q: value is not a string", pointer)
+	}
+
+	return token, nil
+}
+
+// ExecProvider is a CredentialProvider that runs an external command and
+// reads a subject token from its stdout, mirroring the exec/workload-
+// identity credential plugins used by cloud SDKs (e.g. for a Kubernetes
+// service account token or a CI OIDC token). The command must print a
+// single JSON object on stdout:
+//
+//	{"token": "...", "expiration": "2006-01-02T15:04:05Z07:00"}
+//
+// expiration is optional and, if present, must be RFC 3339.
+type ExecProvider struct {
+	Command string
+	Args    []string
+}
+
+type execProviderOutput struct {
+	Token      string `json:"token"`
+	Expiration string `json:"expiration"`
+}
+
+// Token implements CredentialProvider.
+func (p ExecProvider) Token(ctx context.Context) (string, time.Time, error) {
+	cmd := exec.CommandContext(ctx, p.Command, p.Args...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", time.Time{}, fmt.Errorf("running %s: %w: %s", p.Command, err, stderr.String())
+	}
+
+	var out execProviderOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing output of %s: %w", p.Command, err)
+	}
+
+	if out.Expiration == "" {
+		return out.Token, time.Time{}, nil
+	}
+
+	expiry, err := time.Parse(time.RFC3339, out.Expiration)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing expiration from %s: %w", p.Command, err)
+	}
+
+	return out.Token, expiry, nil
+}
+
+// TokenExchangeProvider composes a CredentialProvider that produces a
+// non-Secret-Server subject token (typically a URLProvider or ExecProvider
+// fronting a workload-identity or federated login token) with an exchange
+// against Secret Server's own token endpoint, enabling CI runners and
+// Kubernetes pods that cannot ship a password to log in.
+type TokenExchangeProvider struct {
+	// SubjectTokenProvider supplies the token to exchange.
+	SubjectTokenProvider CredentialProvider
+
+	// GrantType is the grant_type sent to the token endpoint. Defaults to
+	// "access_token".
+	GrantType string
+
+	// server is set by New, as with PasswordProvider.
+	server *Server
+}
+
+// Token implements CredentialProvider.
+func (p *TokenExchangeProvider) Token(ctx context.Context) (string, time.Time, error) {
+	subjectToken, _, err := p.SubjectTokenProvider.Token(ctx)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("obtaining subject token: %w", err)
+	}
+
+	grantType := p.GrantType
+	if grantType == "" {
+		grantType = "access_token"
+	}
+
+	token, err := p.server.exchangeToken(ctx, grantType, subjectToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token.AccessToken, token.Expiry, nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import "testing"
+
+func TestJSONPointer(t *testing.T) {
+	body := map[string]interface{}{
+		"access_token": "abc123",
+		"nested": map[string]interface{}{
+			"token": "nested-token",
+		},
+		"a/b": "escaped-slug",
+	}
+
+	tests := []struct {
+		name    string
+		pointer string
+		want    string
+		wantErr bool
+	}{
+		{"top-level key", "/access_token", "abc123", false},
+		{"nested key", "/nested/token", "nested-token", false},
+		{"escaped ~1 decodes to a literal slash", "/a~1b", "escaped-slug", false},
+		{"missing key", "/missing", "", true},
+		{"intermediate value is not an object", "/access_token/nope", "", true},
+		{"leaf value is not a string", "/nested", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsonPointer(body, tt.pointer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jsonPointer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("jsonPointer() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RetryPolicy controls retry/backoff behavior for HTTP requests made by a
+// Server.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is sent,
+	// including the first attempt.
+	MaxAttempts int
+
+	// MinWait is the base of the exponential backoff between attempts and
+	// MaxWait its cap; jitter can shorten a wait to half its value.
+	MinWait, MaxWait time.Duration
+
+	// RetryableStatusCodes lists the response status codes that trigger a
+	// retry.
+	RetryableStatusCodes map[int]bool
+}
+
+// defaultRetryPolicy is used whenever Configuration.RetryPolicy is left
+// unset: four attempts, 1-30s exponential backoff, retrying 429, 500, 502,
+// 503 and 504.
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 4,
+		MinWait:     1 * time.Second,
+		MaxWait:     30 * time.Second,
+		RetryableStatusCodes: map[int]bool{
+			http.StatusTooManyRequests:     true,
+			http.StatusInternalServerError: true,
+			http.StatusBadGateway:          true,
+			http.StatusServiceUnavailable:  true,
+			http.StatusGatewayTimeout:      true,
+		},
+	}
+}
+
+// doWithRetry sends req using the Server's http.Client, retrying on
+// connection errors and on the configured retryable status codes with
+// exponential backoff and jitter, honoring a Retry-After header when the
+// server sends one. It returns the decoded response body alongside the
+// raw *http.Response so callers can inspect response headers (such as
+// WWW-Authenticate) even on a non-2xx outcome.
+func (s *Server) doWithRetry(req *http.Request) ([]byte, *http.Response, error) {
+	policy := s.RetryPolicy
+
+	var lastErr error
+
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.Body != nil {
+			if req.GetBody == nil {
+				break
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := s.httpClient.Do(attemptReq)
+		if err != nil {
+			lastErr = err
+			log.Debug().Err(err).Msgf("attempt %d/%d of %s %s failed", attempt, policy.MaxAttempts, req.Method, req.URL.Path)
+		} else if !policy.RetryableStatusCodes[resp.StatusCode] {
+			data, _, err := handleResponse(resp, nil)
+			return data, resp, err
+		} else {
+			lastErr = fmt.Errorf("received retryable status %d from %s %s", resp.StatusCode, req.Method, req.URL.Path)
+
+			if attempt == policy.MaxAttempts {
+				data, _, err := handleResponse(resp, nil)
+				return data, resp, err
+			}
+
+			wait := retryAfter(resp, policy, attempt)
+			resp.Body.Close()
+			log.Debug().Msgf("attempt %d/%d of %s %s got status %d, retrying in %s", attempt, policy.MaxAttempts, req.Method, req.URL.Path, resp.StatusCode, wait)
+
+			if err := sleep(req.Context(), wait); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		if attempt == policy.MaxAttempts {
+			break
+		}
+		if err := sleep(req.Context(), backoff(policy, attempt)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return nil, nil, lastErr
+}
+
+// backoff returns the exponential-with-jitter wait before the given
+// attempt: policy.MinWait doubled per attempt and capped at policy.MaxWait,
+// then scaled by a random factor between 0.5 and 1, so the result can be
+// as low as half of policy.MinWait.
+func backoff(policy RetryPolicy, attempt int) time.Duration {
+	wait := policy.MinWait << (attempt - 1)
+	if wait <= 0 || wait > policy.MaxWait {
+		wait = policy.MaxWait
+	}
+
+	return time.Duration(float64(wait) * (0.5 + rand.Float64()/2))
+}
+
+// retryAfter honors a Retry-After response header (either delay-seconds or
+// an HTTP-date), falling back to the exponential backoff when absent or
+// unparseable.
+func retryAfter(resp *http.Response, policy RetryPolicy, attempt int) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return backoff(policy, attempt)
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait
+		}
+	}
+
+	return backoff(policy, attempt)
+}
+
+// sleep waits for d, returning early with ctx.Err() if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// invalidTokenChallengeRegexp matches the error parameter of a
+// WWW-Authenticate: Bearer challenge, e.g. `Bearer error="invalid_token"`.
+var invalidTokenChallengeRegexp = regexp.MustCompile(`error="([^"]+)"`)
+
+// isInvalidTokenChallenge reports whether resp carries a WWW-Authenticate
+// Bearer challenge with error="invalid_token", meaning the access token we
+// sent was rejected and a forced refresh (rather than a retry) is what's
+// needed.
+func isInvalidTokenChallenge(resp *http.Response) bool {
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		return false
+	}
+
+	match := invalidTokenChallengeRegexp.FindStringSubmatch(resp.Header.Get("WWW-Authenticate"))
+
+	return match != nil && match[1] == "invalid_token"
+}
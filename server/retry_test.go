@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MinWait: time.Second, MaxWait: 30 * time.Second}
+
+	tests := []struct {
+		attempt          int
+		minWant, maxWant time.Duration
+	}{
+		{1, 500 * time.Millisecond, 1 * time.Second},
+		{2, 1 * time.Second, 2 * time.Second},
+		{10, 15 * time.Second, 30 * time.Second}, // 1s<<9 overflows MaxWait, clamped to it
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt=%d", tt.attempt), func(t *testing.T) {
+			// backoff jitters randomly, so sample it a few times rather
+			// than asserting a single value.
+			for i := 0; i < 20; i++ {
+				got := backoff(policy, tt.attempt)
+				if got < tt.minWant || got > tt.maxWant {
+					t.Fatalf("backoff(attempt=%d) = %s, want between %s and %s", tt.attempt, got, tt.minWant, tt.maxWant)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	policy := RetryPolicy{MinWait: time.Second, MaxWait: 30 * time.Second}
+
+	t.Run("delay-seconds header", func(t *testing.T) {
+		resp := &http.Response{Header: http.Header{"Retry-After": {"5"}}}
+		if got := retryAfter(resp, policy, 1); got != 5*time.Second {
+			t.Errorf("retryAfter() = %s, want 5s", got)
+		}
+	})
+
+	t.Run("http-date header in the future", func(t *testing.T) {
+		when := time.Now().Add(10 * time.Second)
+		resp := &http.Response{Header: http.Header{"Retry-After": {when.UTC().Format(http.TimeFormat)}}}
+		got := retryAfter(resp, policy, 1)
+		if got <= 0 || got > 11*time.Second {
+			t.Errorf("retryAfter() = %s, want roughly 10s", got)
+		}
+	})
+
+	t.Run("missing header falls back to backoff", func(t *testing.T) {
+		resp := &http.Response{Header: http.Header{}}
+		got := retryAfter(resp, policy, 1)
+		if got < 500*time.Millisecond || got > time.Second {
+			t.Errorf("retryAfter() = %s, want within backoff(attempt=1) bounds", got)
+		}
+	})
+
+	t.Run("unparseable header falls back to backoff", func(t *testing.T) {
+		resp := &http.Response{Header: http.Header{"Retry-After": {"not-a-value"}}}
+		got := retryAfter(resp, policy, 1)
+		if got < 500*time.Millisecond || got > time.Second {
+			t.Errorf("retryAfter() = %s, want within backoff(attempt=1) bounds", got)
+		}
+	})
+}
+
+func TestIsInvalidTokenChallenge(t *testing.T) {
+	tests := []struct {
+		name string
+		resp *http.Response
+		want bool
+	}{
+		{"nil response", nil, false},
+		{"non-401 status", &http.Response{StatusCode: http.StatusForbidden}, false},
+		{"401 without a challenge", &http.Response{StatusCode: http.StatusUnauthorized, Header: http.Header{}}, false},
+		{
+			"401 with invalid_token challenge",
+			&http.Response{StatusCode: http.StatusUnauthorized, Header: http.Header{"Www-Authenticate": {`Bearer error="invalid_token"`}}},
+			true,
+		},
+		{
+			"401 with a different challenge",
+			&http.Response{StatusCode: http.StatusUnauthorized, Header: http.Header{"Www-Authenticate": {`Bearer error="insufficient_scope"`}}},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isInvalidTokenChallenge(tt.resp); got != tt.want {
+				t.Errorf("isInvalidTokenChallenge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
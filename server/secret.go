@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// resource is the HTTP URL path component for the secrets resource
+const resource = "secrets"
+
+// Secret represents a secret from Delinea Secret Server
+type Secret struct {
+	Name                                                                       string
+	FolderID, ID, SiteID, SecretTemplateID                                     int
+	SecretPolicyID, PasswordTypeWebScriptID                                    int `json:",omitempty"`
+	LauncherConnectAsSecretID, CheckOutIntervalMinutes                         int
+	Active, CheckedOut, CheckOutEnabled                                        bool
+	AutoChangeEnabled, CheckOutChangePasswordEnabled, DelayIndexing            bool
+	EnableInheritPermissions, EnableInheritSecretPolicy, ProxyEnabled          bool
+	RequiresComment, SessionRecordingEnabled, WebLauncherRequiresIncognitoMode bool
+	Fields                                                                     []SecretField `json:"Items"`
+	SshKeyArgs                                                                 *SshKeyArgs   `json:",omitempty"`
+}
+
+// SecretField is an item (field) in the secret
+type SecretField struct {
+	ItemID, FieldID, FileAttachmentID     int
+	FieldName, Slug                       string
+	FieldDescription, Filename, ItemValue string
+	IsFile, IsNotes, IsPassword           bool
+}
+
+// SearchResult is the response from a secret search
+type SearchResult struct {
+	SearchText string
+	Records    []Secret
+}
+
+// SshKeyArgs control whether to generate an SSH key pair and a private key
+// passphrase when the secret template supports such generation.
+//
+// WARNING: this struct is only used for write _request_ bodies, and will not
+// be present in _response_ bodies.
+type SshKeyArgs struct {
+	GeneratePassphrase, GenerateSshKeys bool
+}
+
+// Secret gets the secret with id from the Secret Server of the given tenant
+func (s Server) Secret(id int) (*Secret, error) {
+	return s.SecretContext(context.Background(), id)
+}
+
+// SecretContext is Secret with a caller-supplied context, used to cancel or
+// set a deadline on the fetch.
+func (s Server) SecretContext(ctx context.Context, id int) (*Secret, error) {
+	secret := new(Secret)
+
+	data, err := s.accessResourceContext(ctx, "GET", resource, strconv.Itoa(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, secret); err != nil {
+		log.Error().Err(err).Msgf("parsing response from /%s/%d: %q", resource, id, data)
+		return nil, err
+	}
+
+	// automatically download file attachments and substitute them for the
+	// (dummy) ItemValue, so as to make the process transparent to the caller
+	for index, element := range secret.Fields {
+		if element.IsFile && element.FileAttachmentID != 0 && element.Filename != "" {
+			path := fmt.Sprintf("%d/fields/%s", id, element.Slug)
+
+			data, err := s.accessResourceContext(ctx, "GET", resource, path, nil)
+			if err != nil {
+				return nil, err
+			}
+			secret.Fields[index].ItemValue = string(data)
+		}
+	}
+
+	return secret, nil
+}
+
+// Secrets searches for secrets matching searchText in field, or across the
+// default searchable fields if field is empty
+func (s Server) Secrets(searchText, field string) ([]Secret, error) {
+	return s.SecretsContext(context.Background(), searchText, field)
+}
+
+// SecretsContext is Secrets with a caller-supplied context.
+func (s Server) SecretsContext(ctx context.Context, searchText, field string) ([]Secret, error) {
+	searchResult := new(SearchResult)
+
+	data, err := s.searchResourcesContext(ctx, resource, searchText, field)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, searchResult); err != nil {
+		log.Error().Err(err).Msgf("parsing response from /%s/%s: %q", resource, searchText, data)
+		return nil, err
+	}
+
+	// secrets returned in search results are not fully populated
+	secrets := make([]Secret, len(searchResult.Records))
+	for i, record := range searchResult.Records {
+		secret, err := s.SecretContext(ctx, record.ID)
+		if err != nil {
+			return nil, err
+		}
+		secrets[i] = *secret
+	}
+
+	return secrets, nil
+}
+
+// CreateSecret creates secret and returns the Secret Server's copy of it
+func (s Server) CreateSecret(secret Secret) (*Secret, error) {
+	return s.CreateSecretContext(context.Background(), secret)
+}
+
+// CreateSecretContext is CreateSecret with a caller-supplied context.
+func (s Server) CreateSecretContext(ctx context.Context, secret Secret) (*Secret, error) {
+	return s.writeSecretContext(ctx, secret, "POST", "/")
+}
+
+// UpdateSecret updates secret and returns the Secret Server's copy of it
+func (s Server) UpdateSecret(secret Secret) (*Secret, error) {
+	return s.UpdateSecretContext(context.Background(), secret)
+}
+
+// UpdateSecretContext is UpdateSecret with a caller-supplied context.
+func (s Server) UpdateSecretContext(ctx context.Context, secret Secret) (*Secret, error) {
+	if secret.SshKeyArgs != nil && (secret.SshKeyArgs.GenerateSshKeys || secret.SshKeyArgs.GeneratePassphrase) {
+		return nil, fmt.Errorf("SSH key and passphrase generation is only supported during secret creation, could not update the secret named %q", secret.Name)
+	}
+	secret.SshKeyArgs = nil
+	return s.writeSecretContext(ctx, secret, "PUT", strconv.Itoa(secret.ID))
+}
+
+// writeSecretContext implements CreateSecretContext and UpdateSecretContext.
+func (s Server) writeSecretContext(ctx context.Context, secret Secret, method, path string) (*Secret, error) {
+	writtenSecret := new(Secret)
+
+	template, err := s.SecretTemplateContext(ctx, secret.SecretTemplateID)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the user did not request SSH key generation, separate the
+	// secret's fields into file fields and general fields, since we
+	// need to take active control of either providing the files'
+	// contents or deleting them. Otherwise, SSH key generation is
+	// responsible for populating the contents of the file fields.
+	//
+	// NOTE!!! This implies support for *either* file contents provided
+	// by the SSH generator *or* file contents provided by the user.
+	// This SDK does not support secret templates that accept both kinds
+	// of file fields.
+	var fileFields, generalFields []SecretField
+	if secret.SshKeyArgs == nil || !secret.SshKeyArgs.GenerateSshKeys {
+		fileFields, generalFields, err = secret.separateFileFields(template)
+		if err != nil {
+			return nil, err
+		}
+		secret.Fields = generalFields
+	}
+
+	// If no SSH generation is called for, remove the SshKeyArgs value.
+	// Simply having the value in the Secret object causes the
+	// server to throw an error if the template is not geared towards
+	// SSH key generation, even if both of the struct's members are
+	// false.
+	if secret.SshKeyArgs != nil && !secret.SshKeyArgs.GenerateSshKeys && !secret.SshKeyArgs.GeneratePassphrase {
+		secret.SshKeyArgs = nil
+	}
+
+	// If the user specifies no items, perhaps because all the fields are
+	// generated, apply an empty array to keep the server from rejecting the
+	// request for missing a required element.
+	if secret.Fields == nil {
+		secret.Fields = make([]SecretField, 0)
+	}
+
+	data, err := s.accessResourceContext(ctx, method, resource, path, secret)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, writtenSecret); err != nil {
+		log.Error().Err(err).Msgf("parsing response from /%s: %q", resource, data)
+		return nil, err
+	}
+
+	if err := s.updateFilesContext(ctx, writtenSecret.ID, fileFields); err != nil {
+		return nil, err
+	}
+
+	return s.SecretContext(ctx, writtenSecret.ID)
+}
+
+// DeleteSecret deletes the secret with the given id
+func (s Server) DeleteSecret(id int) error {
+	return s.DeleteSecretContext(context.Background(), id)
+}
+
+// DeleteSecretContext is DeleteSecret with a caller-supplied context.
+func (s Server) DeleteSecretContext(ctx context.Context, id int) error {
+	_, err := s.accessResourceContext(ctx, "DELETE", resource, strconv.Itoa(id), nil)
+	return err
+}
+
+// Field returns the value of the field with the name fieldName
+func (s Secret) Field(fieldName string) (string, bool) {
+	for _, field := range s.Fields {
+		if fieldName == field.FieldName || fieldName == field.Slug {
+			return field.ItemValue, true
+		}
+	}
+	log.Debug().Msgf("no matching field for name '%s' in secret '%s'", fieldName, s.Name)
+	return "", false
+}
+
+// FieldById returns the value of the field with the given field ID
+func (s Secret) FieldById(fieldId int) (string, bool) {
+	for _, field := range s.Fields {
+		if fieldId == field.FieldID {
+			return field.ItemValue, true
+		}
+	}
+	log.Debug().Msgf("no matching field for ID '%d' in secret '%s'", fieldId, s.Name)
+	return "", false
+}
+
+// updateFilesContext iterates the list of file fields and if the field's item value is empty,
+// deletes the file, otherwise, uploads the contents of the item value as the new/updated
+// file attachment.
+func (s Server) updateFilesContext(ctx context.Context, secretId int, fileFields []SecretField) error {
+	type fieldMod struct {
+		Slug  string
+		Dirty bool
+		Value interface{}
+	}
+
+	type fieldMods struct {
+		SecretFields []fieldMod
+	}
+
+	type secretPatch struct {
+		Data fieldMods
+	}
+
+	for _, element := range fileFields {
+		if element.ItemValue == "" {
+			path := fmt.Sprintf("%d/general", secretId)
+			input := secretPatch{Data: fieldMods{SecretFields: []fieldMod{{Slug: element.Slug, Dirty: true, Value: nil}}}}
+			if _, err := s.accessResourceContext(ctx, "PATCH", resource, path, input); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.uploadFileContext(ctx, secretId, element); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// separateFileFields iterates the fields on this secret, and separates them into file
+// fields and non file fields, using the field definitions in the given template as a
+// guide. File fields are returned as the first output, non file fields as the second
+// output.
+func (s Secret) separateFileFields(template *SecretTemplate) ([]SecretField, []SecretField, error) {
+	var fileFields, nonFileFields []SecretField
+
+	for _, field := range s.Fields {
+		slug := field.Slug
+		if slug == "" {
+			var found bool
+			if slug, found = template.FieldIdToSlug(field.FieldID); !found {
+				return nil, nil, fmt.Errorf("field id %d is not defined on the secret template with id %d", field.FieldID, template.ID)
+			}
+		}
+		templateField, found := template.GetField(slug)
+		if !found {
+			return nil, nil, fmt.Errorf("field name %q is not defined on the secret template with id %d", slug, template.ID)
+		}
+		if templateField.IsFile {
+			fileFields = append(fileFields, field)
+		} else {
+			nonFileFields = append(nonFileFields, field)
+		}
+	}
+
+	return fileFields, nonFileFields, nil
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -9,13 +10,19 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// defaultTokenExpirySkew is how far ahead of a token's expiry the client
+// starts treating it as stale, so a refresh has time to complete before
+// the server actually rejects the old token.
+const defaultTokenExpirySkew = 30 * time.Second
+
 const (
 	cloudBaseURLTemplate string = "https://%s.secretservercloud.%s/"
 	defaultAPIPathURI    string = "/api/v1"
@@ -35,11 +42,56 @@ type Configuration struct {
 	ServerURL, TLD, Tenant, apiPathURI, tokenPathURI string
 	TLSClientConfig                                  *tls.Config
 	LogLevel                                         LogLevel
+
+	// TokenStore, if set, is used to load a cached token when the Server is
+	// created and to save it whenever a new one is obtained, so that tokens
+	// can survive process restarts.
+	TokenStore TokenStore
+
+	// TokenExpirySkew is how far ahead of its reported expiry a cached
+	// access token is refreshed. Defaults to defaultTokenExpirySkew.
+	TokenExpirySkew time.Duration
+
+	// CredentialProvider supplies the access token used to authenticate to
+	// the REST API. If unset, it is derived from Credentials: an
+	// AccessToken yields a StaticTokenProvider, otherwise a
+	// PasswordProvider using Username, Password and Domain.
+	CredentialProvider CredentialProvider
+
+	// RetryPolicy controls retry/backoff behavior for requests. Defaults
+	// to defaultRetryPolicy().
+	RetryPolicy RetryPolicy
+
+	// HTTPClient, if set, is used for every request instead of a client
+	// built from Transport/TLSClientConfig, so callers can inject their
+	// own instrumentation (OpenTelemetry round-trippers, mocked
+	// transports in tests, corporate proxy configs, mTLS client certs).
+	HTTPClient *http.Client
+
+	// Transport, if set, is cloned to build the default HTTPClient instead
+	// of http.DefaultTransport. Ignored if HTTPClient is set.
+	Transport *http.Transport
 }
 
 // Server provides access to secrets stored in Delinea Secret Server
 type Server struct {
 	Configuration
+
+	httpClient *http.Client
+
+	// tokens is a pointer so that it is shared by every copy of a Server:
+	// Secret, Secrets, CreateSecret and the rest of the exported API use
+	// value receivers, so a Server is copied on every call, and a
+	// sync.Mutex or Token embedded by value would protect and cache
+	// nothing beyond that one throwaway copy.
+	tokens *tokenCache
+}
+
+// tokenCache holds the cached access token shared by every copy of a
+// Server, along with the mutex serializing its refresh.
+type tokenCache struct {
+	mu    sync.Mutex
+	token Token
 }
 
 // New returns an initialized Secrets object
@@ -50,8 +102,18 @@ func New(config Configuration) (*Server, error) {
 	if config.TLD == "" {
 		config.TLD = defaultTLD
 	}
-	if config.TLSClientConfig != nil {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = config.TLSClientConfig
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		var transport *http.Transport
+		if config.Transport != nil {
+			transport = config.Transport.Clone()
+		} else {
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+		}
+		if config.TLSClientConfig != nil {
+			transport.TLSClientConfig = config.TLSClientConfig
+		}
+		httpClient = &http.Client{Transport: transport}
 	}
 	if config.apiPathURI == "" {
 		config.apiPathURI = defaultAPIPathURI
@@ -61,6 +123,26 @@ func New(config Configuration) (*Server, error) {
 		config.tokenPathURI = defaultTokenPathURI
 	}
 	config.tokenPathURI = strings.Trim(config.tokenPathURI, "/")
+	if config.TokenExpirySkew == 0 {
+		config.TokenExpirySkew = defaultTokenExpirySkew
+	}
+	// Default each RetryPolicy field independently, rather than swapping
+	// in defaultRetryPolicy() wholesale, so a caller can set just one
+	// field (e.g. an extra RetryableStatusCodes entry) without losing
+	// the defaults for the rest.
+	defaultPolicy := defaultRetryPolicy()
+	if config.RetryPolicy.MaxAttempts == 0 {
+		config.RetryPolicy.MaxAttempts = defaultPolicy.MaxAttempts
+	}
+	if config.RetryPolicy.MinWait == 0 {
+		config.RetryPolicy.MinWait = defaultPolicy.MinWait
+	}
+	if config.RetryPolicy.MaxWait == 0 {
+		config.RetryPolicy.MaxWait = defaultPolicy.MaxWait
+	}
+	if config.RetryPolicy.RetryableStatusCodes == nil {
+		config.RetryPolicy.RetryableStatusCodes = defaultPolicy.RetryableStatusCodes
+	}
 
 	switch config.LogLevel {
 	case LevelTrace:
@@ -75,11 +157,40 @@ func New(config Configuration) (*Server, error) {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
 
-	return &Server{config}, nil
+	if config.CredentialProvider == nil {
+		if config.Credentials.AccessToken != "" {
+			config.CredentialProvider = StaticTokenProvider{AccessToken: config.Credentials.AccessToken}
+		} else {
+			config.CredentialProvider = &PasswordProvider{
+				Username: config.Credentials.Username,
+				Password: config.Credentials.Password,
+				Domain:   config.Credentials.Domain,
+			}
+		}
+	}
+
+	server := &Server{Configuration: config, httpClient: httpClient, tokens: &tokenCache{}}
+
+	switch provider := config.CredentialProvider.(type) {
+	case *PasswordProvider:
+		provider.server = server
+	case *TokenExchangeProvider:
+		provider.server = server
+	}
+
+	if config.TokenStore != nil {
+		if token, err := config.TokenStore.Load(); err != nil {
+			log.Warn().Err(err).Msg("loading cached token")
+		} else if token != nil {
+			server.tokens.token = *token
+		}
+	}
+
+	return server, nil
 }
 
 // urlFor is the URL for the given resource and path
-func (s Server) urlFor(resource, path string) string {
+func (s *Server) urlFor(resource, path string) string {
 	var baseURL string
 
 	if s.ServerURL == "" {
@@ -102,9 +213,66 @@ func (s Server) urlFor(resource, path string) string {
 	}
 }
 
+// urlForSearch is the URL for searching resource for searchText, optionally
+// restricted to a single field.
+func (s *Server) urlForSearch(resource, searchText, field string) string {
+	var baseURL string
+
+	if s.ServerURL == "" {
+		baseURL = fmt.Sprintf(cloudBaseURLTemplate, s.Tenant, s.TLD)
+	} else {
+		baseURL = s.ServerURL
+	}
+
+	u := fmt.Sprintf("%s/%s/%s?paging.filter.searchText=%s&paging.filter.searchField=%s&paging.filter.doNotCalculateTotal=true&paging.take=30&paging.skip=0",
+		strings.Trim(baseURL, "/"),
+		strings.Trim(s.apiPathURI, "/"),
+		strings.Trim(resource, "/"),
+		url.QueryEscape(searchText),
+		url.QueryEscape(field))
+
+	if field == "" {
+		return u + "&paging.filter.extendedFields=Machine&paging.filter.extendedFields=Notes&paging.filter.extendedFields=Username"
+	}
+	return u + "&paging.filter.isExactMatch=true"
+}
+
+// searchResourcesContext uses the accessToken to search for resources
+// matching searchText, optionally restricted to field, with a
+// caller-supplied context.
+func (s *Server) searchResourcesContext(ctx context.Context, resource, searchText, field string) ([]byte, error) {
+	switch resource {
+	case "secrets":
+	default:
+		message := "unknown resource"
+
+		log.Error().Msgf("%s: %s", message, resource)
+		return nil, fmt.Errorf(message)
+	}
+
+	return s.doAuthenticated(ctx, func(accessToken string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.urlForSearch(resource, searchText, field), nil)
+		if err != nil {
+			log.Error().Msgf("creating search req: /%s: %s", resource, err)
+			return nil, err
+		}
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+
+		log.Debug().Msgf("calling GET %s", req.URL.String())
+
+		return req, nil
+	})
+}
+
 // accessResource uses the accessToken to access the API resource.
 // It assumes an appropriate combination of method, resource, path and input.
-func (s Server) accessResource(method, resource, path string, input interface{}) ([]byte, error) {
+func (s *Server) accessResource(method, resource, path string, input interface{}) ([]byte, error) {
+	return s.accessResourceContext(context.Background(), method, resource, path, input)
+}
+
+// accessResourceContext is accessResource with a caller-supplied context,
+// used to cancel or set a deadline on the request.
+func (s *Server) accessResourceContext(ctx context.Context, method, resource, path string, input interface{}) ([]byte, error) {
 	switch resource {
 	case "secrets":
 	case "secret-templates":
@@ -115,67 +283,93 @@ func (s Server) accessResource(method, resource, path string, input interface{})
 		return nil, fmt.Errorf(message)
 	}
 
-	body := bytes.NewBuffer([]byte{})
+	bodyBytes := []byte{}
 
 	if input != nil {
-		if data, err := json.Marshal(input); err == nil {
-			body = bytes.NewBuffer(data)
-		} else {
+		data, err := json.Marshal(input)
+		if err != nil {
 			log.Error().Err(err).Msg("marshaling the request body to JSON")
 			return nil, err
 		}
+		bodyBytes = data
 	}
 
-	req, err := http.NewRequest(method, s.urlFor(resource, path), body)
-	if err != nil {
-		log.Error().Msgf("creating req: %s /%s/%s: %s", method, resource, path, err)
-		return nil, err
-	}
+	return s.doAuthenticated(ctx, func(accessToken string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, s.urlFor(resource, path), bytes.NewReader(bodyBytes))
+		if err != nil {
+			log.Error().Msgf("creating req: %s /%s/%s: %s", method, resource, path, err)
+			return nil, err
+		}
+
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+
+		switch method {
+		case "POST", "PUT", "PATCH":
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		log.Debug().Msgf("calling %s %s", method, req.URL.String())
+
+		return req, nil
+	})
+}
 
-	accessToken, err := s.getAccessToken()
+// doAuthenticated sends the request built by buildReq, authenticated with a
+// bearer token from getAccessTokenContext. buildReq is called again, with a
+// freshly-obtained token, if the server challenges the first token as
+// invalid via a WWW-Authenticate: Bearer error="invalid_token" response, so
+// that a stale cached token is refreshed exactly once and future calls
+// don't keep failing against a token the server has already rejected;
+// buildReq must therefore be safe to call more than once.
+func (s *Server) doAuthenticated(ctx context.Context, buildReq func(accessToken string) (*http.Request, error)) ([]byte, error) {
+	accessToken, err := s.getAccessTokenContext(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("error getting accessToken")
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", "Bearer "+accessToken)
+	forcedRefresh := false
 
-	switch method {
-	case "POST", "PUT", "PATCH":
-		req.Header.Set("Content-Type", "application/json")
-	}
+	for {
+		req, err := buildReq(accessToken)
+		if err != nil {
+			return nil, err
+		}
 
-	log.Debug().Msgf("calling %s %s", method, req.URL.String())
+		data, resp, err := s.doWithRetry(req)
+		if err == nil {
+			return data, nil
+		}
+
+		if !forcedRefresh && isInvalidTokenChallenge(resp) {
+			forcedRefresh = true
+			s.invalidateToken()
 
-	data, _, err := handleResponse((&http.Client{}).Do(req))
+			if accessToken, err = s.getAccessTokenContext(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
-	return data, err
+		return nil, err
+	}
 }
 
 // uploadFile uploads the file described in the given fileField to the
 // secret at the given secretId as a multipart/form-data request.
-func (s Server) uploadFile(secretId int, fileField SecretField) error {
+func (s *Server) uploadFile(secretId int, fileField SecretField) error {
+	return s.uploadFileContext(context.Background(), secretId, fileField)
+}
+
+// uploadFileContext is uploadFile with a caller-supplied context.
+func (s *Server) uploadFileContext(ctx context.Context, secretId int, fileField SecretField) error {
 	log.Debug().Msgf("uploading a file to the '%s' field with filename '%s'", fileField.Slug, fileField.Filename)
-	body := bytes.NewBuffer([]byte{})
 	path := fmt.Sprintf("%d/fields/%s", secretId, fileField.Slug)
 
-	// Fetch the access token
-	accessToken, err := s.getAccessToken()
-	if err != nil {
-		log.Error().Err(err).Msg("error getting accessToken")
-		return err
-	}
-
 	// Create the multipart form
+	body := bytes.NewBuffer([]byte{})
 	multipartWriter := multipart.NewWriter(body)
-	filename := fileField.Filename
-	if filename == "" {
-		filename = "File.txt"
-		log.Debug().Msgf("field has no filename, setting its filename to '%s'", filename)
-	} else if match, _ := regexp.Match("[^.]+\\.\\w+$", []byte(filename)); !match {
-		filename = filename + ".txt"
-		log.Debug().Msgf("field has no filename extension, setting its filename to '%s'", filename)
-	}
+	filename := normalizeUploadFilename(fileField.Filename)
 	form, err := multipartWriter.CreateFormFile("file", filename)
 	if err != nil {
 		return err
@@ -184,60 +378,78 @@ func (s Server) uploadFile(secretId int, fileField SecretField) error {
 	if err != nil {
 		return err
 	}
-	err = multipartWriter.Close()
-	if err != nil {
+	if err = multipartWriter.Close(); err != nil {
 		return err
 	}
+	bodyBytes := body.Bytes()
+	contentType := multipartWriter.FormDataContentType()
 
-	// Make the request
-	req, err := http.NewRequest("PUT", s.urlFor(resource, path), body)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
-	log.Debug().Msgf("uploading file with PUT %s", req.URL.String())
-	_, _, err = handleResponse((&http.Client{}).Do(req))
+	_, err = s.doAuthenticated(ctx, func(accessToken string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.urlFor(resource, path), bytes.NewReader(bodyBytes))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Content-Type", contentType)
+		log.Debug().Msgf("uploading file with PUT %s", req.URL.String())
+		return req, nil
+	})
 
 	return err
 }
 
-// getAccessToken gets an OAuth2 Access Grant and returns the token
-// endpoint and get an accessGrant.
-func (s Server) getAccessToken() (string, error) {
-	if s.Credentials.AccessToken != "" {
-		return s.Credentials.AccessToken, nil
-	}
+// getAccessToken returns a valid access token, transparently renewing it
+// through the configured CredentialProvider when it is missing or within
+// its expiry skew of expiring. Concurrent callers share a single renewal:
+// the token mutex is held for the whole check-and-refresh so that a
+// stampede of Secret calls on an expired token only hits the provider once.
+func (s *Server) getAccessToken() (string, error) {
+	return s.getAccessTokenContext(context.Background())
+}
 
-	values := url.Values{
-		"username":   {s.Credentials.Username},
-		"password":   {s.Credentials.Password},
-		"grant_type": {"password"},
-	}
-	if s.Credentials.Domain != "" {
-		values["domain"] = []string{s.Credentials.Domain}
+// getAccessTokenContext is getAccessToken with a caller-supplied context.
+func (s *Server) getAccessTokenContext(ctx context.Context) (string, error) {
+	s.tokens.mu.Lock()
+	defer s.tokens.mu.Unlock()
+
+	if s.tokens.token.valid(s.TokenExpirySkew) {
+		return s.tokens.token.AccessToken, nil
 	}
 
-	body := strings.NewReader(values.Encode())
-	data, _, err := handleResponse(http.Post(s.urlFor("token", ""), "application/x-www-form-urlencoded", body))
+	accessToken, expiry, err := s.CredentialProvider.Token(ctx)
 	if err != nil {
-		log.Error().Err(err).Msg("grant response error")
 		return "", err
 	}
 
-	grant := struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		TokenType    string `json:"token_type"`
-		ExpiresIn    int    `json:"expires_in"`
-	}{}
+	s.setToken(accessToken, expiry)
 
-	if err = json.Unmarshal(data, &grant); err != nil {
-		log.Error().Err(err).Msg("parsing grant response")
-		return "", err
-	}
+	return accessToken, nil
+}
 
-	return grant.AccessToken, nil
+// invalidateToken discards the cached token, forcing the next
+// getAccessTokenContext call to obtain a fresh one from the
+// CredentialProvider rather than reusing one the server has rejected.
+func (s *Server) invalidateToken() {
+	s.tokens.mu.Lock()
+	defer s.tokens.mu.Unlock()
+
+	s.tokens.token = Token{}
+}
+
+// setToken records accessToken and expiry as the current token, preserving
+// any refresh token a provider has stashed on it directly, and, if a
+// TokenStore is configured, persists the result so it survives process
+// restarts. Callers must hold s.tokens.mu.
+func (s *Server) setToken(accessToken string, expiry time.Time) {
+	s.tokens.token.AccessToken = accessToken
+	s.tokens.token.Expiry = expiry
+
+	if s.TokenStore == nil {
+		return
+	}
+	if err := s.TokenStore.Save(s.tokens.token); err != nil {
+		log.Warn().Err(err).Msg("saving token to TokenStore")
+	}
 }
 
 type LogLevel int
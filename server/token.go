@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Token is a cached OAuth2 grant: the access token used to authenticate API
+// calls, the refresh token used to renew it without a password, and the
+// access token's computed expiry.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+// valid reports whether the token has an access token and is not within
+// skew of its expiry.
+func (t Token) valid(skew time.Duration) bool {
+	if t.AccessToken == "" {
+		return false
+	}
+	if t.Expiry.IsZero() {
+		return true
+	}
+	return time.Now().Add(skew).Before(t.Expiry)
+}
+
+// TokenStore persists a Token across process restarts. Load is called once
+// when a Server is created; Save is called every time a new token is
+// obtained, whether by password grant or refresh.
+type TokenStore interface {
+	Load() (*Token, error)
+	Save(Token) error
+}
+
+// grant is the shape of a response from the /oauth2/token endpoint,
+// whatever the grant_type used to obtain it.
+type grant struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func (g grant) toToken() Token {
+	token := Token{
+		AccessToken:  g.AccessToken,
+		RefreshToken: g.RefreshToken,
+	}
+	if g.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(g.ExpiresIn) * time.Second)
+	}
+	return token
+}
+
+// passwordGrant exchanges a username and password for an access token via
+// grant_type=password.
+func (s *Server) passwordGrant(ctx context.Context, username, password, domain string) (Token, error) {
+	values := url.Values{
+		"username":   {username},
+		"password":   {password},
+		"grant_type": {"password"},
+	}
+	if domain != "" {
+		values["domain"] = []string{domain}
+	}
+
+	return s.requestToken(ctx, values)
+}
+
+// refreshToken exchanges a refresh token for a new access token via
+// grant_type=refresh_token.
+func (s *Server) refreshToken(ctx context.Context, refreshToken string) (Token, error) {
+	values := url.Values{
+		"refresh_token": {refreshToken},
+		"grant_type":    {"refresh_token"},
+	}
+
+	return s.requestToken(ctx, values)
+}
+
+// exchangeToken exchanges a subject token obtained from another
+// CredentialProvider for a Secret Server access token via the given
+// grant_type.
+func (s *Server) exchangeToken(ctx context.Context, grantType, subjectToken string) (Token, error) {
+	values := url.Values{
+		"subject_token": {subjectToken},
+		"grant_type":    {grantType},
+	}
+
+	return s.requestToken(ctx, values)
+}
+
+func (s *Server) requestToken(ctx context.Context, values url.Values) (Token, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.urlFor("token", ""), strings.NewReader(values.Encode()))
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	data, _, err := s.doWithRetry(req)
+	if err != nil {
+		log.Error().Err(err).Msg("grant response error")
+		return Token{}, err
+	}
+
+	var g grant
+	if err = json.Unmarshal(data, &g); err != nil {
+		log.Error().Err(err).Msg("parsing grant response")
+		return Token{}, err
+	}
+
+	return g.toToken(), nil
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenValid(t *testing.T) {
+	tests := []struct {
+		name  string
+		token Token
+		skew  time.Duration
+		want  bool
+	}{
+		{"empty token is invalid", Token{}, time.Minute, false},
+		{"no expiry never goes stale", Token{AccessToken: "x"}, time.Minute, true},
+		{"well before expiry is valid", Token{AccessToken: "x", Expiry: time.Now().Add(time.Hour)}, time.Minute, true},
+		{"inside the skew is invalid", Token{AccessToken: "x", Expiry: time.Now().Add(30 * time.Second)}, time.Minute, false},
+		{"already expired is invalid", Token{AccessToken: "x", Expiry: time.Now().Add(-time.Minute)}, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.token.valid(tt.skew); got != tt.want {
+				t.Errorf("valid(%s) = %v, want %v", tt.skew, got, tt.want)
+			}
+		})
+	}
+}
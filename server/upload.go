@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ProgressFunc reports upload progress as a file streams to the server.
+// bytesSent is cumulative; totalBytes is the size passed to
+// UploadSecretFile.
+type ProgressFunc func(bytesSent, totalBytes int64)
+
+// UploadOption configures UploadSecretFile.
+type UploadOption func(*uploadOptions)
+
+type uploadOptions struct {
+	progress ProgressFunc
+}
+
+// WithProgress reports upload progress to fn as the file streams to the
+// server, so CLI and TUI callers can render a progress bar.
+func WithProgress(fn ProgressFunc) UploadOption {
+	return func(o *uploadOptions) {
+		o.progress = fn
+	}
+}
+
+// UploadSecretFile streams r, of the given size, into the file field named
+// slug on the secret with the given secretID. Unlike uploadFile, it never
+// buffers the whole file in memory: the multipart body is wired to an
+// io.Pipe and written as r is read, with the request's ContentLength set
+// up front so the server doesn't need chunked encoding. Because the body
+// can't be replayed, this request is sent once and is not retried.
+func (s *Server) UploadSecretFile(ctx context.Context, secretID int, slug, filename string, r io.Reader, size int64, opts ...UploadOption) error {
+	var options uploadOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.progress != nil {
+		r = &progressReader{r: r, total: size, fn: options.progress}
+	}
+
+	filename = normalizeUploadFilename(filename)
+
+	header, footer, boundary, err := multipartEnvelope(filename)
+	if err != nil {
+		return err
+	}
+
+	// Fetch the access token before wiring up the pipe: r (and the
+	// goroutine's io.Copy into the pipe) must not be started until we
+	// know the request will actually be sent, since io.Pipe's Write
+	// blocks until something reads from pr, and nothing ever will if we
+	// return here instead of reaching httpClient.Do.
+	accessToken, err := s.getAccessTokenContext(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("error getting accessToken")
+		return err
+	}
+
+	pr, pw := io.Pipe()
+
+	multipartWriter := multipart.NewWriter(pw)
+	if err := multipartWriter.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	go func() {
+		form, err := multipartWriter.CreateFormFile("file", filename)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(form, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(multipartWriter.Close())
+	}()
+
+	path := fmt.Sprintf("%d/fields/%s", secretID, slug)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.urlFor(resource, path), pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	req.ContentLength = int64(len(header)) + size + int64(len(footer))
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+
+	log.Debug().Msgf("streaming upload with PUT %s", req.URL.String())
+
+	_, _, err = handleResponse(s.httpClient.Do(req))
+
+	return err
+}
+
+// uploadFilenameExtensionRegexp matches a filename that already has a
+// dotted extension, e.g. "key.pem" or "archive.tar.gz".
+var uploadFilenameExtensionRegexp = regexp.MustCompile(`[^.]+\.\w+$`)
+
+// normalizeUploadFilename defaults filename to "File.txt" when empty, and
+// appends ".txt" when it has no extension, so that both upload paths (the
+// buffered uploadFileContext and the streaming UploadSecretFile) send the
+// API a filename it will accept.
+func normalizeUploadFilename(filename string) string {
+	if filename == "" {
+		log.Debug().Msg("field has no filename, setting its filename to 'File.txt'")
+		return "File.txt"
+	}
+	if !uploadFilenameExtensionRegexp.MatchString(filename) {
+		log.Debug().Msgf("field has no filename extension, setting its filename to '%s.txt'", filename)
+		return filename + ".txt"
+	}
+	return filename
+}
+
+// multipartEnvelope returns the exact header and footer bytes a
+// multipart.Writer would produce around a single "file" form file part
+// named filename, and the boundary used to produce them, so the total
+// Content-Length of a streamed upload can be computed without buffering
+// the file itself.
+func multipartEnvelope(filename string) (header, footer []byte, boundary string, err error) {
+	var buf bytes.Buffer
+
+	w := multipart.NewWriter(&buf)
+	boundary = w.Boundary()
+
+	if _, err = w.CreateFormFile("file", filename); err != nil {
+		return nil, nil, "", err
+	}
+	header = append([]byte(nil), buf.Bytes()...)
+
+	buf.Reset()
+	if err = w.Close(); err != nil {
+		return nil, nil, "", err
+	}
+	footer = append([]byte(nil), buf.Bytes()...)
+
+	return header, footer, boundary, nil
+}
+
+// progressReader wraps an io.Reader, invoking fn with the running byte
+// count on every Read.
+type progressReader struct {
+	r     io.Reader
+	total int64
+	sent  int64
+	fn    ProgressFunc
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	if n > 0 {
+		p.sent += int64(n)
+		p.fn(p.sent, p.total)
+	}
+	return n, err
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"mime/multipart"
+	"testing"
+)
+
+func TestMultipartEnvelope(t *testing.T) {
+	header, footer, boundary, err := multipartEnvelope("secret.txt")
+	if err != nil {
+		t.Fatalf("multipartEnvelope() error = %v", err)
+	}
+	if boundary == "" {
+		t.Fatal("expected a non-empty boundary")
+	}
+
+	// UploadSecretFile relies on header+content+footer being
+	// byte-identical to what a multipart.Writer would produce for the
+	// same content, since it uses their lengths to precompute
+	// Content-Length without buffering the file itself.
+	content := []byte("hello world")
+
+	var want bytes.Buffer
+	w := multipart.NewWriter(&want)
+	if err := w.SetBoundary(boundary); err != nil {
+		t.Fatalf("SetBoundary() error = %v", err)
+	}
+	form, err := w.CreateFormFile("file", "secret.txt")
+	if err != nil {
+		t.Fatalf("CreateFormFile() error = %v", err)
+	}
+	if _, err := form.Write(content); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	var got bytes.Buffer
+	got.Write(header)
+	got.Write(content)
+	got.Write(footer)
+
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("multipartEnvelope() assembled body =\n%q\nwant\n%q", got.Bytes(), want.Bytes())
+	}
+}
+
+func TestNormalizeUploadFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty defaults to File.txt", "", "File.txt"},
+		{"no extension gets .txt appended", "secret", "secret.txt"},
+		{"existing extension is left alone", "key.pem", "key.pem"},
+		{"multiple dots are left alone", "archive.tar.gz", "archive.tar.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeUploadFilename(tt.in); got != tt.want {
+				t.Errorf("normalizeUploadFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}